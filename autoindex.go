@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+func init() {
+	registerBackend("apache", newAutoindexGallery)
+}
+
+// autoindexGallery targets a plain Apache/nginx "Index of /..." directory
+// listing with no gallery3 path prefix. Unlike gallery3, a directory entry
+// is recognizable straight from the listing: autoindex always links
+// subdirectories with a trailing slash.
+type autoindexGallery struct {
+	address string
+}
+
+func newAutoindexGallery(address string) Gallery {
+	return &autoindexGallery{address: address}
+}
+
+func (g *autoindexGallery) url(nodePath string) string {
+	return g.address + nodePath
+}
+
+func (g *autoindexGallery) List(ctx context.Context, nodePath string, opts FetchOptions) ([]Entry, error) {
+	resp, err := get(ctx, g.url(nodePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if getContentType(resp) != "text/html" {
+		return nil, ErrNotADirectory
+	}
+
+	names, err := getNodes(ctx, nodePath, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(names))
+	for _, name := range names {
+		if name == "../" {
+			continue
+		}
+
+		kind := KindFile
+		if strings.HasSuffix(name, "/") {
+			kind = KindDir
+		}
+
+		entries = append(entries, Entry{Name: strings.TrimSuffix(name, "/"), Kind: kind})
+	}
+
+	return entries, nil
+}
+
+func (g *autoindexGallery) Fetch(ctx context.Context, nodePath string) (io.ReadCloser, string, error) {
+	resp, err := get(ctx, g.url(nodePath), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.Body, getContentType(resp), nil
+}
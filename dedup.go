@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+)
+
+const dedupIndexFileName = ".pho-index.db"
+
+// dedupRecord is what's persisted per remote node: the content hash we saw
+// there, and which local file on disk actually holds that content (which
+// may belong to a different node entirely, if the same image lives under
+// more than one remote path).
+type dedupRecord struct {
+	Hash      string `json:"hash"`
+	LocalFile string `json:"local_file"`
+}
+
+// dedupIndex is a JSON-backed, content-addressed index rooted at a single
+// local gallery directory, despite the .db name (kept for readability on
+// disk; there's no BoltDB dependency available to this build). It tracks
+// both remote path -> hash and hash -> local file, so fetch can recognize
+// the same image under a new remote path and link to it instead of
+// downloading it again, and diff can tell new/moved/changed apart.
+type dedupIndex struct {
+	path   string
+	mu     sync.Mutex
+	byNode map[string]dedupRecord
+	byHash map[string]string
+}
+
+func loadDedupIndex(localPath string) (*dedupIndex, error) {
+	idx := &dedupIndex{
+		path:   path.Join(localPath, dedupIndexFileName),
+		byNode: map[string]dedupRecord{},
+		byHash: map[string]string{},
+	}
+
+	data, err := os.ReadFile(idx.path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &idx.byNode); err != nil {
+		return nil, err
+	}
+
+	for _, rec := range idx.byNode {
+		if _, ok := idx.byHash[rec.Hash]; !ok {
+			idx.byHash[rec.Hash] = rec.LocalFile
+		}
+	}
+
+	return idx, nil
+}
+
+// lookupHash returns the local file already holding this content, if any.
+func (idx *dedupIndex) lookupHash(hash string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	f, ok := idx.byHash[hash]
+	return f, ok
+}
+
+// hashForNode returns the hash last recorded for a remote node, if fetch or
+// diff has seen it before.
+func (idx *dedupIndex) hashForNode(node string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	rec, ok := idx.byNode[node]
+	return rec.Hash, ok
+}
+
+func (idx *dedupIndex) record(node string, hash string, localFile string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.byNode[node] = dedupRecord{Hash: hash, LocalFile: localFile}
+	if _, ok := idx.byHash[hash]; !ok {
+		idx.byHash[hash] = localFile
+	}
+
+	data, err := json.MarshalIndent(idx.byNode, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, idx.path)
+}
+
+// hashBody drains r and returns the hex SHA-256 of everything read.
+func hashBody(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkContent points newPath at the bytes already stored under existing,
+// hard-linking where the platform supports it and falling back to a
+// symlink on Windows.
+func linkContent(existing string, newPath string) error {
+	if runtime.GOOS == "windows" {
+		return os.Symlink(existing, newPath)
+	}
+
+	return os.Link(existing, newPath)
+}
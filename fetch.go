@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cheggaaa/pb"
+	"github.com/urfave/cli"
+	"golang.org/x/time/rate"
+)
+
+var concurrencyFlag = cli.IntFlag{
+	Name:  "concurrency",
+	Value: 4,
+	Usage: "number of workers writing images to disk concurrently (discovery, including each leaf's own GET, stays sequential)",
+}
+
+var rateFlag = cli.Float64Flag{
+	Name:  "rate",
+	Usage: "maximum requests per second against the gallery (0 for unlimited)",
+}
+
+var noProgressFlag = cli.BoolFlag{
+	Name:  "no-progress",
+	Usage: "don't show the progress bar",
+}
+
+var silentFlag = cli.BoolFlag{
+	Name:  "silent",
+	Usage: "suppress all non-error output, including the progress bar",
+}
+
+var dedupFlag = cli.BoolFlag{
+	Name:  "dedup",
+	Usage: "hash each download and hard-link instead of re-fetching content already present elsewhere locally",
+}
+
+// fetchJob is a discovered image waiting to be written to disk. walk has
+// already resolved the node and fetched it, so a worker's only job is to
+// stream the body to disk and report progress.
+type fetchJob struct {
+	result FetchResult
+	node   string
+}
+
+// fetch is the pho fetch command: dedup is whatever --dedup was passed.
+func fetch(cliCtx *cli.Context) {
+	runFetch(cliCtx, cliCtx.Bool("dedup"))
+}
+
+// mirror is pho mirror: a fetch that always dedups, content-addressing
+// every download against the local .pho-index.db regardless of --dedup.
+func mirror(cliCtx *cli.Context) {
+	runFetch(cliCtx, true)
+}
+
+// runFetch walks the gallery in the calling goroutine, one node at a time:
+// every leaf's GET (classification and all) happens there, synchronously,
+// before its body ever reaches a worker. --concurrency only parallelizes
+// what happens after that GET returns (streaming the body to disk), not
+// request issuance itself, since the worker pool would otherwise have to
+// double-fetch gallery3 leaves to classify them ahead of time. --rate is
+// still honored against real request volume, via onPreflight below, which
+// runs synchronously right before each GET fires.
+func runFetch(cliCtx *cli.Context, dedup bool) {
+	ctx, cancel := commandContext(cliCtx)
+	defer cancel()
+
+	gallery := getGallery(cliCtx)
+	recurse := cliCtx.Bool("recurse")
+	verbose := cliCtx.Bool("verbose")
+	silent := cliCtx.Bool("silent")
+	showProgress := !silent && !cliCtx.Bool("no-progress")
+
+	concurrency := cliCtx.Int("concurrency")
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var limiter *rate.Limiter
+	if r := cliCtx.Float64("rate"); r > 0 {
+		limiter = rate.NewLimiter(rate.Limit(r), 1)
+	}
+
+	remotePath := "/"
+	if len(cliCtx.Args()) > 0 {
+		remotePath = cliCtx.Args()[0]
+	}
+
+	localPath := "."
+	if len(cliCtx.Args()) > 1 {
+		localPath = cliCtx.Args()[1]
+	}
+
+	meta, err := loadMetaStore(localPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var idx *dedupIndex
+	if dedup {
+		idx, err = loadDedupIndex(localPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var bar *pb.ProgressBar
+	if showProgress {
+		bar = pb.New(0)
+		bar.ShowSpeed = true
+		bar.SetUnits(pb.U_BYTES)
+		bar.Start()
+		defer bar.Finish()
+	}
+
+	var count int64
+	jobs := make(chan fetchJob)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				n, err := writeJob(localPath, job, bar, meta, idx, ctx.Done())
+				if err != nil {
+					log.Printf("%v", err)
+					continue
+				}
+
+				if n == 0 {
+					continue
+				}
+
+				if verbose {
+					log.Printf("Downloaded %v bytes for %s\n", n, job.node)
+				}
+
+				if done := atomic.AddInt64(&count, 1); !silent && done%100 == 0 {
+					log.Printf("Downloaded %v images", done)
+				}
+			}
+		}()
+	}
+
+	onIndex := func(ctx context.Context, base string, node string, depth int) error {
+		if verbose {
+			log.Printf("Traversing %v", node)
+		}
+
+		return nil
+	}
+
+	// onPreflight lets the fetch resume a partial download or validate an
+	// already-complete one against the sidecar metadata, instead of always
+	// re-transferring the full body. It also paces request issuance against
+	// --rate: it runs synchronously right before the GET fires (both for
+	// gallery3's combined classify-and-fetch request and a plain leaf
+	// fetch), which is the only place in this walker-then-worker-pool
+	// architecture where that's possible, since discovery itself is not
+	// parallelized across the worker pool.
+	onPreflight := func(ctx context.Context, nodePath string) (FetchOptions, error) {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return FetchOptions{}, err
+			}
+		}
+
+		var opts FetchOptions
+
+		partFile := path.Join(localPath, nodePath) + ".part"
+		if info, statErr := os.Stat(partFile); statErr == nil && info.Size() > 0 {
+			opts.RangeFrom = info.Size()
+			return opts, nil
+		}
+
+		if m, ok := meta.get(nodePath); ok {
+			opts.IfNoneMatch = m.ETag
+			opts.IfModifiedSince = m.LastModified
+		}
+
+		return opts, nil
+	}
+
+	onLeaf := func(ctx context.Context, result FetchResult, node string) error {
+		if result.StatusCode == http.StatusNotModified {
+			if result.Body != nil {
+				result.Body.Close()
+			}
+			if verbose {
+				log.Printf("Unchanged, skipping %s", node)
+			}
+			return nil
+		}
+
+		switch result.ContentType {
+		case "image/png", "image/jpeg":
+			if bar != nil && result.ContentLength > 0 {
+				// bar.Start() runs a refresher goroutine that reads
+				// Total via atomic.LoadInt64; mutate it the same way
+				// instead of a plain += to avoid racing with it.
+				atomic.AddInt64(&bar.Total, result.ContentLength)
+			}
+
+			select {
+			case jobs <- fetchJob{result: result, node: node}:
+				return nil
+			case <-ctx.Done():
+				result.Body.Close()
+				return ctx.Err()
+			}
+		default:
+			if result.Body != nil {
+				result.Body.Close()
+			}
+			return fmt.Errorf("Unknown content type %v:%v", result.ContentType, node)
+		}
+	}
+
+	err = walk(ctx, gallery, remotePath, recurse, 0, onIndex, onLeaf, onPreflight)
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("interrupted: %v", err)
+			return
+		}
+
+		log.Fatal(err)
+	}
+}
+
+// writeJob streams a single discovered image to a <file>.part in the target
+// folder and, once it lands completely, renames it into place so a reader
+// never sees a partial file under its final name. It returns the number of
+// bytes written; a return of 0 with a nil error means the file was already
+// complete and nothing was transferred.
+//
+// When idx is non-nil, the body is hashed as it's written (via
+// io.MultiWriter, so the write and the hash share a single pass over the
+// bytes). If the resulting hash is already in the index under a different
+// local file, the freshly written copy is discarded and localFile is linked
+// to the existing one instead of kept as a second copy of the same content.
+func writeJob(localPath string, job fetchJob, bar *pb.ProgressBar, meta *metaStore, idx *dedupIndex, interrupted <-chan struct{}) (int64, error) {
+	defer job.result.Body.Close()
+
+	folder := path.Join(localPath, path.Dir(job.node))
+	file := path.Base(job.node)
+	localFile := path.Join(folder, file)
+	partFile := localFile + ".part"
+
+	if _, err := os.Stat(localFile); err == nil {
+		return 0, nil
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if job.result.StatusCode == http.StatusPartialContent {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	output, err := os.OpenFile(partFile, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	var reader io.Reader = job.result.Body
+	if bar != nil {
+		reader = bar.NewProxyReader(reader)
+	}
+
+	var hasher hash.Hash
+	var dst io.Writer = output
+	if idx != nil {
+		hasher = sha256.New()
+		if job.result.StatusCode == http.StatusPartialContent {
+			// Hash the bytes a previous run already left in partFile
+			// first, so the sum covers the whole file and not just the
+			// resumed tail.
+			prior, err := os.Open(partFile)
+			if err == nil {
+				_, err = io.Copy(hasher, prior)
+				prior.Close()
+			}
+			if err != nil {
+				output.Close()
+				return 0, err
+			}
+		}
+		dst = io.MultiWriter(output, hasher)
+	}
+
+	n, err := copyCancelable(dst, reader, interrupted)
+	output.Close()
+	if err != nil {
+		// Leave partFile in place: the next run resumes it with a
+		// Range request instead of starting over.
+		return n, fmt.Errorf("%s: %v", partFile, err)
+	}
+
+	if hasher != nil {
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if existing, ok := idx.lookupHash(sum); ok && existing != localFile {
+			if _, statErr := os.Stat(existing); statErr == nil {
+				if err := os.Remove(partFile); err != nil {
+					return n, err
+				}
+				if err := linkContent(existing, localFile); err != nil {
+					return n, err
+				}
+				if err := idx.record(job.node, sum, existing); err != nil {
+					log.Printf("failed to persist dedup index for %s: %v", job.node, err)
+				}
+				return n, nil
+			}
+		}
+
+		if err := os.Rename(partFile, localFile); err != nil {
+			return n, err
+		}
+
+		if err := idx.record(job.node, sum, localFile); err != nil {
+			log.Printf("failed to persist dedup index for %s: %v", job.node, err)
+		}
+	} else if err := os.Rename(partFile, localFile); err != nil {
+		return n, err
+	}
+
+	if job.result.ETag != "" || job.result.LastModified != "" {
+		if err := meta.put(job.node, fileMeta{ETag: job.result.ETag, LastModified: job.result.LastModified}); err != nil {
+			log.Printf("failed to persist metadata for %s: %v", job.node, err)
+		}
+	}
+
+	return n, nil
+}
+
+// copyCancelable behaves like io.Copy but stops as soon as interrupted is
+// closed, so a SIGINT mid-transfer can't leave a file on disk that looks
+// complete.
+func copyCancelable(dst io.Writer, src io.Reader, interrupted <-chan struct{}) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		select {
+		case <-interrupted:
+			return written, fmt.Errorf("interrupted")
+		default:
+		}
+
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+
+		if er != nil {
+			if er == io.EOF {
+				return written, nil
+			}
+			return written, er
+		}
+	}
+}
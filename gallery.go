@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+)
+
+// EntryKind tells the walker whether a discovered Entry is already known to
+// be a directory or a leaf. Backends that can't tell from the listing alone
+// (gallery3) leave it as KindUnknown and the walker resolves it lazily by
+// trying to List the node.
+type EntryKind int
+
+const (
+	KindUnknown EntryKind = iota
+	KindDir
+	KindFile
+)
+
+// Entry is a single item discovered while listing a gallery directory. Name
+// is relative to the path that was listed.
+type Entry struct {
+	Name string
+	Kind EntryKind
+}
+
+// ErrNotADirectory is returned by List when the requested path turned out
+// to be a leaf rather than something that can be listed.
+var ErrNotADirectory = errors.New("not a directory")
+
+// leafResult is a variant of ErrNotADirectory: List returns it instead of
+// the bare sentinel when it already has the leaf's body in hand (because
+// classifying the node required fetching it), so walk can hand that body
+// straight to onLeaf rather than fetching the same node a second time.
+type leafResult struct {
+	result FetchResult
+}
+
+func (l *leafResult) Error() string { return ErrNotADirectory.Error() }
+func (l *leafResult) Unwrap() error { return ErrNotADirectory }
+
+// Gallery is the seam between pho's commands (ls/diff/fetch) and a specific
+// remote layout. Implementations live in gallery3.go, autoindex.go, and
+// manifest.go, and are registered with registerBackend from an init().
+//
+// opts is passed through to List, not just Fetch, because a backend that
+// can't classify a node as a directory or a leaf without fetching it
+// (gallery3) uses the same request to do both: if the request turns out to
+// land on a leaf, List returns a *leafResult wrapping the FetchResult it
+// already has, so the caller never needs to issue a second request just to
+// read the body it classified a moment ago.
+type Gallery interface {
+	List(ctx context.Context, nodePath string, opts FetchOptions) ([]Entry, error)
+	Fetch(ctx context.Context, nodePath string) (io.ReadCloser, string, error)
+}
+
+// FetchOptions lets a caller ask for a resumable or conditional fetch.
+// Backends that don't implement ResumableGallery simply ignore them and
+// fetch behaves like an unconditional GET.
+type FetchOptions struct {
+	RangeFrom       int64
+	IfNoneMatch     string
+	IfModifiedSince string
+}
+
+// FetchResult carries the metadata fetch needs to drive a resumable,
+// conditional download, beyond what the plain Gallery.Fetch signature
+// exposes.
+type FetchResult struct {
+	Body          io.ReadCloser
+	ContentType   string
+	ContentLength int64
+	StatusCode    int
+	ETag          string
+	LastModified  string
+}
+
+// ResumableGallery is an optional capability: backends that can satisfy
+// Range and If-None-Match/If-Modified-Since requests against the remote
+// implement it so fetch can resume partial downloads and skip unchanged
+// images without a full body transfer.
+type ResumableGallery interface {
+	Gallery
+	FetchResumable(ctx context.Context, nodePath string, opts FetchOptions) (FetchResult, error)
+}
+
+var backends = map[string]func(address string) Gallery{}
+
+func registerBackend(name string, ctor func(address string) Gallery) {
+	backends[name] = ctor
+}
+
+func newGalleryBackend(name string, address string) (Gallery, error) {
+	ctor, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown gallery backend %q", name)
+	}
+
+	return ctor(address), nil
+}
+
+// fetchWithOptions calls FetchResumable when the backend supports it, and
+// otherwise falls back to a plain Fetch whose result looks like an
+// unconditional 200.
+func fetchWithOptions(ctx context.Context, gallery Gallery, nodePath string, opts FetchOptions) (FetchResult, error) {
+	if resumable, ok := gallery.(ResumableGallery); ok {
+		return resumable.FetchResumable(ctx, nodePath, opts)
+	}
+
+	body, ct, err := gallery.Fetch(ctx, nodePath)
+	if err != nil {
+		return FetchResult{}, err
+	}
+
+	return FetchResult{Body: body, ContentType: ct, StatusCode: http.StatusOK}, nil
+}
+
+type indexAction func(ctx context.Context, base string, node string, depth int) error
+type leafAction func(ctx context.Context, result FetchResult, node string) error
+
+// preflightAction lets a caller attach FetchOptions (Range, If-None-Match,
+// If-Modified-Since, ...) to the fetch walk is about to issue for a node,
+// based on state only the caller knows about (e.g. what's already on disk).
+// It runs synchronously, immediately before the request itself, so it's
+// also where a caller should pace request issuance (e.g. rate limiting);
+// an error aborts the walk the same as any other failure.
+type preflightAction func(ctx context.Context, nodePath string) (FetchOptions, error)
+
+func doNothingOnLeaf(ctx context.Context, result FetchResult, node string) error {
+	if result.Body != nil {
+		result.Body.Close()
+	}
+
+	return nil
+}
+
+type leafError struct {
+	inner error
+}
+
+func (l *leafError) Error() string {
+	return fmt.Sprintf("Leaf error: %v", l.inner)
+}
+
+// walk descends a gallery from nodePath, calling onIndex for every entry it
+// discovers and onLeaf once it resolves a node to an actual file. It has no
+// backend-specific code: all of the classification ambiguity is handled by
+// Gallery.List, either by returning ErrNotADirectory (walk then fetches
+// the node itself and hands the result to onLeaf) or a *leafResult (onLeaf
+// reuses the body List already fetched while classifying it).
+func walk(ctx context.Context, gallery Gallery, nodePath string, recurse bool, depth int, onIndex indexAction, onLeaf leafAction, onPreflight preflightAction) error {
+	var opts FetchOptions
+	if onPreflight != nil {
+		var err error
+		opts, err = onPreflight(ctx, nodePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := gallery.List(ctx, nodePath, opts)
+	if err != nil {
+		var lr *leafResult
+		if errors.As(err, &lr) {
+			if err := onLeaf(ctx, lr.result, nodePath); err != nil {
+				return &leafError{err}
+			}
+
+			return nil
+		}
+
+		if errors.Is(err, ErrNotADirectory) {
+			return fetchLeaf(ctx, gallery, nodePath, onLeaf, onPreflight)
+		}
+
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := onIndex(ctx, nodePath, entry.Name, depth)
+		if err == nil && recurse {
+			next := path.Join(nodePath, entry.Name)
+			if entry.Kind == KindFile {
+				err = handleWalkError(fetchLeaf(ctx, gallery, next, onLeaf, onPreflight))
+			} else {
+				err = handleWalkError(walk(ctx, gallery, next, recurse, depth+1, onIndex, onLeaf, onPreflight))
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fetchLeaf(ctx context.Context, gallery Gallery, nodePath string, onLeaf leafAction, onPreflight preflightAction) error {
+	var opts FetchOptions
+	if onPreflight != nil {
+		var err error
+		opts, err = onPreflight(ctx, nodePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := fetchWithOptions(ctx, gallery, nodePath, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := onLeaf(ctx, result, nodePath); err != nil {
+		return &leafError{err}
+	}
+
+	return nil
+}
+
+func handleWalkError(err error) error {
+	if err != nil {
+		if _, is := err.(*leafError); is {
+			log.Printf("%v", err)
+			err = nil
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+)
+
+func init() {
+	registerBackend("gallery3", newGallery3Gallery)
+}
+
+// gallery3Gallery preserves pho's original behavior against a Gallery 3
+// album tree rooted at /var/albums. Directories and leaf images are
+// indistinguishable from an anchor alone, so List has to fetch the node to
+// classify it by Content-Type. It reuses that same request as the leaf
+// fetch itself (returning a *leafResult instead of ErrNotADirectory when
+// the node isn't a directory), so a leaf still costs exactly one request,
+// same as the old single-GET walkPath.
+type gallery3Gallery struct {
+	address string
+}
+
+func newGallery3Gallery(address string) Gallery {
+	return &gallery3Gallery{address: address}
+}
+
+func (g *gallery3Gallery) remotePath(nodePath string) string {
+	return path.Join("/var/albums", nodePath)
+}
+
+func (g *gallery3Gallery) url(nodePath string) string {
+	return g.address + g.remotePath(nodePath)
+}
+
+func (g *gallery3Gallery) List(ctx context.Context, nodePath string, opts FetchOptions) ([]Entry, error) {
+	result, err := g.fetch(ctx, nodePath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.ContentType != "text/html" {
+		return nil, &leafResult{result: result}
+	}
+	defer result.Body.Close()
+
+	names, err := getNodes(ctx, g.remotePath(nodePath), result.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(names))
+	for i, name := range names {
+		entries[i] = Entry{Name: name}
+	}
+
+	return entries, nil
+}
+
+func (g *gallery3Gallery) Fetch(ctx context.Context, nodePath string) (io.ReadCloser, string, error) {
+	result, err := g.fetch(ctx, nodePath, FetchOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result.Body, result.ContentType, nil
+}
+
+func (g *gallery3Gallery) FetchResumable(ctx context.Context, nodePath string, opts FetchOptions) (FetchResult, error) {
+	return g.fetch(ctx, nodePath, opts)
+}
+
+// fetch issues the single GET shared by List (for classification) and
+// Fetch/FetchResumable (for reading the body), applying Range and
+// conditional headers from opts either way.
+func (g *gallery3Gallery) fetch(ctx context.Context, nodePath string, opts FetchOptions) (FetchResult, error) {
+	headers := http.Header{}
+	if opts.RangeFrom > 0 {
+		headers.Set("Range", fmt.Sprintf("bytes=%d-", opts.RangeFrom))
+	}
+	if opts.IfNoneMatch != "" {
+		headers.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	if opts.IfModifiedSince != "" {
+		headers.Set("If-Modified-Since", opts.IfModifiedSince)
+	}
+
+	resp, err := get(ctx, g.url(nodePath), headers)
+	if err != nil {
+		return FetchResult{}, err
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// Our range no longer lines up with the remote resource; fall
+		// back to fetching it in full.
+		resp.Body.Close()
+		resp, err = get(ctx, g.url(nodePath), nil)
+		if err != nil {
+			return FetchResult{}, err
+		}
+	}
+
+	return FetchResult{
+		Body:          resp.Body,
+		ContentType:   getContentType(resp),
+		ContentLength: resp.ContentLength,
+		StatusCode:    resp.StatusCode,
+		ETag:          resp.Header.Get("ETag"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+	}, nil
+}
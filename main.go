@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/html"
@@ -25,7 +28,26 @@ var verboseFlag = cli.BoolFlag{
 	Name: "verbose",
 }
 
+var timeoutFlag = cli.DurationFlag{
+	Name:  "timeout",
+	Usage: "abort the command if it runs longer than this (0 for no timeout)",
+}
+
+var backendFlag = cli.StringFlag{
+	Name:  "backend",
+	Value: "gallery3",
+	Usage: "gallery backend to talk to: gallery3, apache, or manifest",
+}
+
+// rootCtx is cancelled on SIGINT/SIGTERM so any in-flight walk/get call can
+// unwind cleanly instead of main simply exiting underneath it.
+var rootCtx context.Context
+
 func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	rootCtx = ctx
+
 	app := cli.NewApp()
 	app.Name = "pho"
 	app.Usage = "scraper for photo gallery 3 galleries"
@@ -36,6 +58,8 @@ func main() {
 			EnvVar: "PHOTO_GALLERY_URL",
 			Usage:  "base url to the photo gallery",
 		},
+		timeoutFlag,
+		backendFlag,
 	}
 
 	app.Commands = []cli.Command{
@@ -49,116 +73,113 @@ func main() {
 			Name:   "diff",
 			Usage:  "pho diff [remote path] [local path]",
 			Action: diff,
-			Flags:  []cli.Flag{recurseFlag, verboseFlag},
+			Flags:  []cli.Flag{recurseFlag, verboseFlag, dedupFlag},
 		},
 		{
 			Name:   "fetch",
 			Usage:  "pho fetch [remote path] [local path]",
 			Action: fetch,
-			Flags:  []cli.Flag{recurseFlag, verboseFlag},
+			Flags: []cli.Flag{
+				recurseFlag,
+				verboseFlag,
+				concurrencyFlag,
+				rateFlag,
+				noProgressFlag,
+				silentFlag,
+				dedupFlag,
+			},
+		},
+		{
+			Name:   "mirror",
+			Usage:  "pho mirror [remote path] [local path]: fetch, always deduping content-addressed against .pho-index.db",
+			Action: mirror,
+			Flags: []cli.Flag{
+				recurseFlag,
+				verboseFlag,
+				concurrencyFlag,
+				rateFlag,
+				noProgressFlag,
+				silentFlag,
+			},
 		},
 	}
 
 	app.Run(os.Args)
 }
 
-func fetch(ctx *cli.Context) {
-	address := getAddress(ctx)
-	recurse := ctx.Bool("recurse")
-	verbose := ctx.Bool("verbose")
-
-	remotePath := "/"
-	if len(ctx.Args()) > 0 {
-		remotePath = ctx.Args()[0]
-	}
-
-	localPath := "."
-	if len(ctx.Args()) > 1 {
-		localPath = ctx.Args()[1]
+// commandContext derives the context a command should run under: rootCtx,
+// cancelled on SIGINT/SIGTERM, additionally bounded by --timeout if set.
+func commandContext(ctx *cli.Context) (context.Context, context.CancelFunc) {
+	if timeout := ctx.GlobalDuration("timeout"); timeout > 0 {
+		return context.WithTimeout(rootCtx, timeout)
 	}
 
-	onIndex := func(base string, node string, depth int) error {
-		if verbose {
-			log.Printf("Traversing %v", node)
-		}
-
-		return nil
-	}
-
-	count := 0
-	onLeaf := func(resp *http.Response, node string, ct string) error {
-		switch ct {
-		case "image/png":
-			fallthrough
-		case "image/jpeg":
-			folder := path.Join(localPath, path.Dir(node))
-			file := path.Base(node)
-			localFile := path.Join(folder, file)
-			_, err := os.Stat(localFile)
-			if os.IsNotExist(err) {
-				err = os.MkdirAll(folder, os.ModePerm)
-				if err != nil {
-					return err
-				}
-
-				output, err := os.Create(localFile)
-				if err != nil {
-					return err
-				}
-
-				defer output.Close()
-				defer resp.Body.Close()
-				n, err := io.Copy(output, resp.Body)
-				if err != nil {
-					return err
-				}
-
-				if verbose {
-					log.Printf("Downloaded %v bytes for %s\n", n, localFile)
-				}
-
-				count++
-				if count%100 == 0 {
-					log.Printf("Downloaded %v images", count)
-				}
-
-			} else if err != nil {
-				return err
-			}
+	return rootCtx, func() {}
+}
 
-			return nil
-		default:
-			return fmt.Errorf("Unknown content type %v:%v", ct, node)
-		}
-	}
+// getGallery builds the Gallery backend named by --backend against --url.
+func getGallery(ctx *cli.Context) Gallery {
+	address := getAddress(ctx)
 
-	err := walkPath(address, remotePath, recurse, 0, verbose, onIndex, onLeaf)
+	backend := ctx.GlobalString("backend")
+	gallery, err := newGalleryBackend(backend, address)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	return gallery
 }
 
-func diff(ctx *cli.Context) {
-	address := getAddress(ctx)
-	recurse := ctx.Bool("recurse")
-	verbose := ctx.Bool("verbose")
+func diff(cliCtx *cli.Context) {
+	ctx, cancel := commandContext(cliCtx)
+	defer cancel()
+
+	gallery := getGallery(cliCtx)
+	recurse := cliCtx.Bool("recurse")
+	verbose := cliCtx.Bool("verbose")
+	dedup := cliCtx.Bool("dedup")
 
 	remotePath := "/"
-	if len(ctx.Args()) > 0 {
-		remotePath = ctx.Args()[0]
+	if len(cliCtx.Args()) > 0 {
+		remotePath = cliCtx.Args()[0]
 	}
 
 	localPath := "."
-	if len(ctx.Args()) > 1 {
-		localPath = ctx.Args()[1]
+	if len(cliCtx.Args()) > 1 {
+		localPath = cliCtx.Args()[1]
+	}
+
+	var idx *dedupIndex
+	if dedup {
+		var err error
+		idx, err = loadDedupIndex(localPath)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	onIndex := func(base string, node string, depth int) error {
+	onIndex := func(ctx context.Context, base string, node string, depth int) error {
+		if verbose {
+			log.Printf("Traversing %v", node)
+		}
+
+		// With --dedup and --recurse, leaves are classified by content
+		// hash in onLeaf below instead of here. But onLeaf is only ever
+		// reached through recursion, so without --recurse this entry
+		// would otherwise go unreported entirely; fall back to the plain
+		// existence check in that case.
+		if dedup && recurse {
+			return nil
+		}
+
 		location := path.Join(localPath, base, node)
 		_, err := os.Stat(location)
 		if os.IsNotExist(err) {
-			fmt.Printf("%s\n", location)
+			if dedup {
+				fmt.Printf("new: %s\n", location)
+			} else {
+				fmt.Printf("%s\n", location)
+			}
 		} else if err != nil {
 			return err
 		}
@@ -166,107 +187,86 @@ func diff(ctx *cli.Context) {
 		return nil
 	}
 
-	err := walkPath(address, remotePath, recurse, 0, verbose, onIndex, doNothingOnLeaf)
-	if err != nil {
-		log.Fatal(err)
-	}
+	onLeaf := leafAction(doNothingOnLeaf)
+	if dedup {
+		onLeaf = func(ctx context.Context, result FetchResult, node string) error {
+			defer func() {
+				if result.Body != nil {
+					result.Body.Close()
+				}
+			}()
 
-}
+			sum, err := hashBody(result.Body)
+			if err != nil {
+				return err
+			}
 
-func ls(ctx *cli.Context) {
-	address := getAddress(ctx)
-	recurse := ctx.Bool("recurse")
-	verbose := ctx.Bool("verbose")
+			localFile := path.Join(localPath, node)
+			if _, statErr := os.Stat(localFile); os.IsNotExist(statErr) {
+				if existing, ok := idx.lookupHash(sum); ok && existing != localFile {
+					fmt.Printf("moved: %s -> %s\n", existing, localFile)
+				} else {
+					fmt.Printf("new: %s\n", localFile)
+				}
+				return nil
+			} else if statErr != nil {
+				return statErr
+			}
 
-	var remotePath string
-	if len(ctx.Args()) > 0 {
-		remotePath = ctx.Args()[0]
-	}
+			if prevHash, ok := idx.hashForNode(node); ok && prevHash != sum {
+				fmt.Printf("changed: %s\n", localFile)
+			}
 
-	onIndex := func(base string, node string, depth int) error {
-		fmt.Println(strings.Repeat("\t", depth) + node)
-		return nil
+			return nil
+		}
 	}
 
-	err := walkPath(address, remotePath, recurse, 0, verbose, onIndex, doNothingOnLeaf)
+	err := walk(ctx, gallery, remotePath, recurse, 0, onIndex, onLeaf, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-type indexAction func(base string, node string, depth int) error
-type leafAction func(resp *http.Response, path string, contentType string) error
 
-func doNothingOnLeaf(resp *http.Response, path string, contentType string) error {
-	return nil
 }
 
-type leafError struct {
-	inner error
-}
+func ls(cliCtx *cli.Context) {
+	ctx, cancel := commandContext(cliCtx)
+	defer cancel()
 
-func (l *leafError) Error() string {
-	return fmt.Sprintf("Leaf error: %v", l.inner)
-}
+	gallery := getGallery(cliCtx)
+	recurse := cliCtx.Bool("recurse")
+	verbose := cliCtx.Bool("verbose")
 
-func walkPath(address string, base string, recurse bool, depth int, verbose bool, onIndex indexAction, onLeaf leafAction) error {
-	remotePath := path.Join("/var/albums", base)
-	resp, err := get(fmt.Sprintf("%s%s", address, remotePath))
-
-	var ct string
-	if err == nil {
-		ct = getContentType(resp)
-		switch ct {
-		case "text/html":
-			body := resp.Body
-			nodes, err := getNodes(remotePath, body)
-			body.Close()
-
-			if err == nil {
-				for _, node := range nodes {
-					err = onIndex(base, node, depth)
-					if err == nil && recurse {
-						next := path.Join(base, node)
-						err = handleWalkError(walkPath(address, next, recurse, depth+1, verbose, onIndex, onLeaf))
-					}
-
-					if err != nil {
-						break
-					}
-				}
-			}
-		default:
-			err = onLeaf(resp, base, ct)
-			if err != nil {
-				err = &leafError{err}
-			}
-		}
+	var remotePath string
+	if len(cliCtx.Args()) > 0 {
+		remotePath = cliCtx.Args()[0]
 	}
 
-	if err != nil {
-		err = fmt.Errorf("%v %v: %v", resp.Request.URL, resp.Status, err)
-	} else if verbose {
-		log.Printf("Done with: %v %v %v", resp.Request.URL, resp.Status, ct)
-	}
+	onIndex := func(ctx context.Context, base string, node string, depth int) error {
+		if verbose {
+			log.Printf("Traversing %v", node)
+		}
 
-	return err
-}
+		fmt.Println(strings.Repeat("\t", depth) + node)
+		return nil
+	}
 
-func handleWalkError(err error) error {
+	err := walk(ctx, gallery, remotePath, recurse, 0, onIndex, doNothingOnLeaf, nil)
 	if err != nil {
-		_, is := err.(*leafError)
-		if is {
-			log.Printf("%v", err)
-			err = nil
-		}
+		log.Fatal(err)
 	}
-
-	return err
 }
 
-func getNodes(remotePath string, body io.ReadCloser) (nodes []string, err error) {
+// getNodes and getContentType/getHref/get below are shared HTTP primitives
+// used by the Gallery backends in gallery3.go, autoindex.go, and
+// manifest.go.
+
+func getNodes(ctx context.Context, remotePath string, body io.ReadCloser) (nodes []string, err error) {
 	tokenizer := html.NewTokenizer(body)
 	for err == nil {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
 		tt := tokenizer.Next()
 		err = tokenizer.Err()
 
@@ -318,12 +318,22 @@ func getHref(t html.Token) (ok bool, href string) {
 	return
 }
 
-var httpClient = &http.Client{Timeout: 15 * time.Second}
+var httpClient = &http.Client{}
 
-func get(url string) (resp *http.Response, err error) {
+func get(ctx context.Context, url string, headers http.Header) (resp *http.Response, err error) {
 	op := func() error {
-		var e error
-		resp, e = httpClient.Get(url)
+		req, e := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if e != nil {
+			return e
+		}
+
+		for key, values := range headers {
+			for _, v := range values {
+				req.Header.Add(key, v)
+			}
+		}
+
+		resp, e = httpClient.Do(req)
 		return e
 	}
 
@@ -331,7 +341,7 @@ func get(url string) (resp *http.Response, err error) {
 		log.Printf("%v waiting %v to retry...\n", err, t)
 	}
 
-	err = backoff.RetryNotify(op, backoff.NewExponentialBackOff(), notify)
+	err = backoff.RetryNotify(op, backoff.WithContext(backoff.NewExponentialBackOff(), ctx), notify)
 
 	return
 }
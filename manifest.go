@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+)
+
+func init() {
+	registerBackend("manifest", newManifestGallery)
+}
+
+// manifestNode mirrors one element of a JSON manifest backend's listing:
+// GET base/manifest.json -> {"entries":[{"name":...,"type":...,"href":...}]}.
+type manifestNode struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Href string `json:"href"`
+}
+
+type manifestListing struct {
+	Entries []manifestNode `json:"entries"`
+}
+
+// manifestGallery targets any static file server willing to publish a
+// manifest.json describing each directory's contents, so pho isn't limited
+// to scraping HTML. A node's href (as opposed to its name) is what's
+// actually fetched, so List remembers the hrefs it has seen for Fetch to
+// look up later.
+type manifestGallery struct {
+	address string
+	mu      sync.Mutex
+	hrefs   map[string]string
+}
+
+func newManifestGallery(address string) Gallery {
+	return &manifestGallery{address: address, hrefs: map[string]string{}}
+}
+
+func (g *manifestGallery) manifestURL(nodePath string) string {
+	return g.address + path.Join(nodePath, "manifest.json")
+}
+
+func (g *manifestGallery) hrefFor(nodePath string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if href, ok := g.hrefs[nodePath]; ok {
+		return href
+	}
+
+	return nodePath
+}
+
+func (g *manifestGallery) List(ctx context.Context, nodePath string, opts FetchOptions) ([]Entry, error) {
+	resp, err := get(ctx, g.manifestURL(nodePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotADirectory
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", g.manifestURL(nodePath), resp.Status)
+	}
+
+	var listing manifestListing
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(listing.Entries))
+	g.mu.Lock()
+	for i, node := range listing.Entries {
+		kind := KindFile
+		if node.Type == "dir" {
+			kind = KindDir
+		}
+
+		entries[i] = Entry{Name: node.Name, Kind: kind}
+		g.hrefs[path.Join(nodePath, node.Name)] = node.Href
+	}
+	g.mu.Unlock()
+
+	return entries, nil
+}
+
+func (g *manifestGallery) Fetch(ctx context.Context, nodePath string) (io.ReadCloser, string, error) {
+	resp, err := get(ctx, g.address+g.hrefFor(nodePath), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.Body, getContentType(resp), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+)
+
+const metaFileName = ".pho-meta.json"
+
+// fileMeta records the validators returned with a completed download so a
+// later run can send a conditional GET and skip the body entirely when the
+// remote image hasn't changed.
+type fileMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// metaStore is a JSON-backed, node-path-addressed cache of fileMeta rooted
+// at a single local gallery directory. It's safe for concurrent use by the
+// fetch worker pool.
+type metaStore struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]fileMeta
+}
+
+func loadMetaStore(localPath string) (*metaStore, error) {
+	m := &metaStore{
+		path:    path.Join(localPath, metaFileName),
+		entries: map[string]fileMeta{},
+	}
+
+	data, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *metaStore) get(node string) (fileMeta, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.entries[node]
+	return meta, ok
+}
+
+func (m *metaStore) put(node string, meta fileMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[node] = meta
+
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.path)
+}